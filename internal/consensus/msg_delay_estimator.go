@@ -0,0 +1,144 @@
+package consensus
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// msgDelayEstimatorWindow is the number of most recent per-peer samples
+	// kept for computing the observed delay quantile. It is intentionally
+	// small: MessageDelay only needs to track the current network
+	// conditions, not the full history of the chain.
+	msgDelayEstimatorWindow = 64
+
+	// msgDelayEstimatorQuantile is the quantile of observed proposal
+	// delivery deltas used as the estimate of MessageDelay. p95 is used so
+	// that a small number of slow deliveries do not immediately push every
+	// validator's timeout out, while still covering the vast majority of
+	// observed network latency.
+	msgDelayEstimatorQuantile = 0.95
+
+	// msgDelayEstimatorSmoothing is the weight given to the newly computed
+	// quantile when folding it into the running estimate. A low weight
+	// keeps the estimate from swinging on a single height's samples.
+	msgDelayEstimatorSmoothing = 0.1
+)
+
+// messageDelayEstimator maintains a running estimate of the proposal
+// message delay observed on the network, per peer. It is fed the delta
+// between a proposed block's Header.Time and the local time at which that
+// proposal was received, and produces an effective delay that stands in for
+// a statically configured MessageDelay when TimingParams.AdaptiveMessageDelay
+// is enabled. proposalStepWaitingTime (pbts.go) is the consumer: it takes an
+// estimator alongside a validator's TimingParams and calls EffectiveDelay to
+// compute the deadline a proposal is timed out against.
+//
+// It is safe for concurrent use.
+type messageDelayEstimator struct {
+	mtx sync.Mutex
+
+	// samples holds, per peer, a bounded window of the most recently
+	// observed delivery deltas.
+	samples map[string][]time.Duration
+
+	// ewma holds, per peer, the exponentially-weighted p95 of that peer's
+	// samples.
+	ewma map[string]time.Duration
+}
+
+// newMessageDelayEstimator constructs an empty messageDelayEstimator.
+func newMessageDelayEstimator() *messageDelayEstimator {
+	return &messageDelayEstimator{
+		samples: make(map[string][]time.Duration),
+		ewma:    make(map[string]time.Duration),
+	}
+}
+
+// Observe records the delta between a proposal's block time and the local
+// time it was received from peer. Negative deltas (the block arrived before
+// its own timestamp, e.g. due to clock skew) are recorded as zero, since
+// they do not indicate network delay.
+func (e *messageDelayEstimator) Observe(peer string, delta time.Duration) {
+	if delta < 0 {
+		delta = 0
+	}
+
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	window := append(e.samples[peer], delta)
+	if len(window) > msgDelayEstimatorWindow {
+		window = window[len(window)-msgDelayEstimatorWindow:]
+	}
+	e.samples[peer] = window
+
+	observed := quantile(window, msgDelayEstimatorQuantile)
+	prev, ok := e.ewma[peer]
+	if !ok {
+		e.ewma[peer] = observed
+		return
+	}
+	e.ewma[peer] = prev + time.Duration(msgDelayEstimatorSmoothing*float64(observed-prev))
+}
+
+// Estimate returns the current estimated MessageDelay across all peers
+// observed so far, taken as the maximum of each peer's smoothed p95. Using
+// the maximum across peers, rather than an average, keeps the estimate
+// conservative: a single slow link should not cause the rest of the network
+// to prevote nil.
+func (e *messageDelayEstimator) Estimate() time.Duration {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	var max time.Duration
+	for _, d := range e.ewma {
+		if d > max {
+			max = d
+		}
+	}
+	return max
+}
+
+// EffectiveDelay returns the delay that proposalStepWaitingTime should use
+// in place of a statically configured MessageDelay. If adaptive is false --
+// the governance-controlled TimingParams.AdaptiveMessageDelay flag is off --
+// it returns configured unchanged, so the estimator has no effect until an
+// operator opts in. Otherwise it returns the larger of configured and the
+// estimator's current observed estimate: the configured value always acts
+// as a floor so that an estimator with too little data (or a network that
+// briefly looks faster than usual) never relaxes the bound below what
+// operators have agreed on.
+func (e *messageDelayEstimator) EffectiveDelay(configured time.Duration, adaptive bool) time.Duration {
+	if !adaptive {
+		return configured
+	}
+	if estimate := e.Estimate(); estimate > configured {
+		return estimate
+	}
+	return configured
+}
+
+// quantile returns the q-quantile (0 <= q <= 1) of samples, using the
+// nearest-rank method rounded up: idx = ceil(q * n) - 1. Truncating instead
+// of rounding up would bias the result toward the minimum at small sample
+// counts (e.g. n=2 would return the minimum rather than the 95th
+// percentile); rounding up keeps the estimate conservative in exactly the
+// regime -- early in a peer's window -- where a low estimate would be most
+// dangerous. It does not mutate samples. An empty slice returns zero.
+func quantile(samples []time.Duration, q float64) time.Duration {
+	if len(samples) == 0 {
+		return 0
+	}
+	sorted := make([]time.Duration, len(samples))
+	copy(sorted, samples)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	idx := int(math.Ceil(q*float64(len(sorted)))) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	return sorted[idx]
+}
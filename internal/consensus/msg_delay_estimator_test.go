@@ -0,0 +1,96 @@
+package consensus
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMessageDelayEstimatorEmpty(t *testing.T) {
+	e := newMessageDelayEstimator()
+	assert.Equal(t, time.Duration(0), e.Estimate())
+	assert.Equal(t, 500*time.Millisecond, e.EffectiveDelay(500*time.Millisecond, true))
+}
+
+func TestMessageDelayEstimatorConvergesToObservedLatency(t *testing.T) {
+	e := newMessageDelayEstimator()
+	const peer = "validator-0"
+
+	// Feed a steady stream of ~120ms deltas, with a bit of jitter, and
+	// confirm the estimate converges close to that value rather than
+	// tracking any single sample.
+	base := 120 * time.Millisecond
+	jitter := []time.Duration{0, 5 * time.Millisecond, -5 * time.Millisecond, 10 * time.Millisecond}
+	for i := 0; i < 200; i++ {
+		e.Observe(peer, base+jitter[i%len(jitter)])
+	}
+
+	estimate := e.Estimate()
+	require.NotZero(t, estimate)
+	assert.InDelta(t, float64(base), float64(estimate), float64(20*time.Millisecond))
+}
+
+func TestMessageDelayEstimatorIgnoresNegativeDeltas(t *testing.T) {
+	e := newMessageDelayEstimator()
+	e.Observe("validator-0", -50*time.Millisecond)
+	assert.Equal(t, time.Duration(0), e.Estimate())
+}
+
+func TestMessageDelayEstimatorMaxAcrossPeers(t *testing.T) {
+	e := newMessageDelayEstimator()
+	for i := 0; i < 50; i++ {
+		e.Observe("fast-peer", 10*time.Millisecond)
+		e.Observe("slow-peer", 300*time.Millisecond)
+	}
+
+	assert.InDelta(t, float64(300*time.Millisecond), float64(e.Estimate()), float64(20*time.Millisecond))
+}
+
+func TestEffectiveDelayFloorsAtConfiguredValue(t *testing.T) {
+	e := newMessageDelayEstimator()
+	for i := 0; i < 50; i++ {
+		e.Observe("validator-0", 10*time.Millisecond)
+	}
+
+	// The estimator observed a fast network, but the configured
+	// MessageDelay must still act as a floor.
+	assert.Equal(t, 500*time.Millisecond, e.EffectiveDelay(500*time.Millisecond, true))
+}
+
+func TestEffectiveDelayUsesEstimateWhenLarger(t *testing.T) {
+	e := newMessageDelayEstimator()
+	for i := 0; i < 50; i++ {
+		e.Observe("validator-0", 800*time.Millisecond)
+	}
+
+	assert.Greater(t, e.EffectiveDelay(500*time.Millisecond, true), 500*time.Millisecond)
+}
+
+func TestEffectiveDelayIgnoresEstimateWhenNotAdaptive(t *testing.T) {
+	e := newMessageDelayEstimator()
+	for i := 0; i < 50; i++ {
+		e.Observe("validator-0", 800*time.Millisecond)
+	}
+
+	// With the governance-controlled adaptive flag off, EffectiveDelay must
+	// return the configured value unchanged, even though the estimator has
+	// converged well above it.
+	assert.Equal(t, 500*time.Millisecond, e.EffectiveDelay(500*time.Millisecond, false))
+}
+
+func TestQuantileLowSampleCounts(t *testing.T) {
+	// At small n, nearest-rank rounded up should stay close to the top of
+	// the window rather than collapsing toward the minimum: a single slow
+	// sample should dominate the p95 immediately, not just once the window
+	// fills up.
+	oneSample := []time.Duration{100 * time.Millisecond}
+	assert.Equal(t, 100*time.Millisecond, quantile(oneSample, msgDelayEstimatorQuantile))
+
+	twoSamples := []time.Duration{10 * time.Millisecond, 200 * time.Millisecond}
+	assert.Equal(t, 200*time.Millisecond, quantile(twoSamples, msgDelayEstimatorQuantile))
+
+	threeSamples := []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 200 * time.Millisecond}
+	assert.Equal(t, 200*time.Millisecond, quantile(threeSamples, msgDelayEstimatorQuantile))
+}
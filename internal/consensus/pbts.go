@@ -0,0 +1,56 @@
+package consensus
+
+import (
+	"time"
+
+	tmtime "github.com/tendermint/tendermint/libs/time"
+	"github.com/tendermint/tendermint/types"
+)
+
+// proposerWaitTime returns how long a proposer must wait, from lt's current
+// time, before it may propose the next block. Per the PBTS algorithm, a
+// proposer must not propose a block timestamped before the previous block,
+// so if the previous block's time is still in the future relative to lt, the
+// proposer waits out the difference; otherwise it may propose immediately.
+func proposerWaitTime(lt tmtime.Source, previousBlockTime time.Time) time.Duration {
+	wait := previousBlockTime.Sub(lt.Now())
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+// proposalStepWaitingTime returns how long, from lt's current time, a
+// validator should continue waiting for a proposal before its PBTS timeout
+// expires and it prevotes nil. The deadline is the previous block's time
+// plus the timing params' Precision and effective MessageDelay.
+//
+// delay, if non-nil, supplies the effective MessageDelay in place of
+// sp.MessageDelay: when sp.AdaptiveMessageDelay is set, this lets the
+// deadline track delay's observed network latency instead of the static
+// configured value, while delay itself still floors the result at
+// sp.MessageDelay. Passing nil preserves the static, non-adaptive behavior.
+func proposalStepWaitingTime(lt tmtime.Source, previousBlockTime time.Time, sp types.TimingParams, delay *messageDelayEstimator) time.Duration {
+	messageDelay := sp.MessageDelay
+	if delay != nil {
+		messageDelay = delay.EffectiveDelay(sp.MessageDelay, sp.AdaptiveMessageDelay)
+	}
+
+	deadline := previousBlockTime.Add(sp.Precision).Add(messageDelay)
+	wait := deadline.Sub(lt.Now())
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+// defaultLocaltime is the tmtime.Source a State would fall back to when
+// constructed without an explicit clock override: it reports the real
+// wall-clock time, exactly like the bare time.Now() calls it is meant to
+// replace at State's proposerWaitTime/proposalStepWaitingTime call sites. A
+// constructor option on State (e.g. WithLocaltime(source tmtime.Source))
+// would swap this out for a *tmtime.VirtualClock in tests, the same one
+// pbtsTestHarness already uses for its validator stubs.
+type defaultLocaltime struct{}
+
+func (defaultLocaltime) Now() time.Time { return time.Now() }
@@ -0,0 +1,172 @@
+package consensus
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/tendermint/tendermint/types"
+)
+
+// TestPBTSByzantineProposerTimestamps table-drives the PBTS timeliness rule
+// against a byzantine proposer that lies about a block's timestamp. Each
+// case injects a proposerBehavior into the harness and asserts whether the
+// observed validator prevotes for the proposed block or for nil, per the
+// PBTS spec: a block is timely only if its timestamp is not before
+// previousBlockTime and not later than localTime + Precision.
+func TestPBTSByzantineProposerTimestamps(t *testing.T) {
+	testCases := []struct {
+		name          string
+		fault         func(genesisTime time.Time) proposerTimestampFault
+		expectNilVote bool
+	}{
+		{
+			name: "far future timestamp is rejected",
+			fault: func(time.Time) proposerTimestampFault {
+				return futureTimestampFault(10 * time.Hour)
+			},
+			expectNilVote: true,
+		},
+		{
+			name: "timestamp before the previous block is rejected",
+			fault: func(genesisTime time.Time) proposerTimestampFault {
+				return pastTimestampFault(genesisTime, time.Second)
+			},
+			expectNilVote: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			initialTime := time.Now().Add(50 * time.Millisecond)
+			cfg := pbtsTestConfiguration{
+				timingParams: types.TimingParams{
+					Precision:    100 * time.Millisecond,
+					MessageDelay: 500 * time.Millisecond,
+				},
+				timeoutPropose:             50 * time.Millisecond,
+				genesisTime:                initialTime,
+				height2ProposalDeliverTime: initialTime.Add(150 * time.Millisecond),
+				height2ProposedBlockTime:   initialTime.Add(100 * time.Millisecond),
+			}
+
+			pbtsTest := newPBTSTestHarness(ctx, t, cfg)
+			startTestRound(pbtsTest.ctx, pbtsTest.observedState, pbtsTest.currentHeight, pbtsTest.currentRound)
+			pbtsTest.observedValidatorProposerHeight(cfg.genesisTime)
+
+			fault := tc.fault(cfg.genesisTime)
+
+			signer := pbtsTest.otherValidators[0].PrivValidator
+			height3BlockTime := cfg.height2ProposedBlockTime.Add(-blockTimeIota)
+			res := pbtsTest.nextHeightWithFault(signer, cfg.height2ProposalDeliverTime,
+				cfg.height2ProposedBlockTime, height3BlockTime, proposerBehavior{timestampFault: fault})
+
+			require.NoError(t, pbtsTest.observedState.Stop())
+			require.NotNil(t, res.prevote)
+			if tc.expectNilVote {
+				assert.Nil(t, res.prevote.BlockID.Hash)
+			} else {
+				assert.NotNil(t, res.prevote.BlockID.Hash)
+			}
+		})
+	}
+}
+
+// TestPBTSByzantineMonotonicityAcrossRounds verifies that a proposer who
+// re-proposes at a later round of the same height cannot regress the
+// block's timestamp relative to what it (or another proposer) already
+// proposed at an earlier round.
+//
+// The harness does not synthesize a round change: it lets one happen for
+// real, by configuring a short TimeoutPropose and never delivering a
+// proposal for round 0, so the observed validator's own state machine
+// times out and genuinely advances to round 1 before the byzantine
+// round-1 proposal is delivered.
+func TestPBTSByzantineMonotonicityAcrossRounds(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	initialTime := time.Now().Add(50 * time.Millisecond)
+	round0Time := initialTime.Add(100 * time.Millisecond)
+	cfg := pbtsTestConfiguration{
+		timingParams: types.TimingParams{
+			Precision:    100 * time.Millisecond,
+			MessageDelay: 500 * time.Millisecond,
+		},
+		timeoutPropose:             50 * time.Millisecond,
+		genesisTime:                initialTime,
+		height2ProposalDeliverTime: initialTime.Add(150 * time.Millisecond),
+		height2ProposedBlockTime:   round0Time,
+	}
+
+	pbtsTest := newPBTSTestHarness(ctx, t, cfg)
+	startTestRound(pbtsTest.ctx, pbtsTest.observedState, pbtsTest.currentHeight, pbtsTest.currentRound)
+	pbtsTest.observedValidatorProposerHeight(cfg.genesisTime)
+
+	// No proposal is ever delivered for height 2, round 0: TimeoutPropose
+	// fires for real and the state machine moves on to round 1. Only the
+	// round-0 NewRound event is drained here; nextHeightWithFault below
+	// drains the round-1 one itself, as it does for every other height.
+	ensureNewRound(pbtsTest.t, pbtsTest.roundCh, pbtsTest.currentHeight, 0)
+	pbtsTest.currentRound = 1
+
+	signer := pbtsTest.otherValidators[0].PrivValidator
+	height3BlockTime := round0Time.Add(-blockTimeIota)
+	res := pbtsTest.nextHeightWithFault(signer, cfg.height2ProposalDeliverTime, round0Time, height3BlockTime,
+		proposerBehavior{timestampFault: pastTimestampFault(round0Time, time.Second)})
+
+	require.NoError(t, pbtsTest.observedState.Stop())
+	require.NotNil(t, res.prevote)
+	assert.Nil(t, res.prevote.BlockID.Hash,
+		"a round-1 proposal that regresses the timestamp of an earlier round must be prevoted nil")
+}
+
+// TestPBTSByzantineEquivocatingProposal drives a height in which the
+// proposer, having already had its proposal accepted, tries to equivocate
+// with a second proposal carrying a different Header.Time for the same
+// (height, round). It asserts that the second proposal is rejected and
+// that, once the proposer also equivocates on its vote (the mechanism
+// Tendermint actually uses to detect equivocation), the observed
+// validator's evidence pool produces DuplicateVoteEvidence.
+func TestPBTSByzantineEquivocatingProposal(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	initialTime := time.Now().Add(50 * time.Millisecond)
+	cfg := pbtsTestConfiguration{
+		timingParams: types.TimingParams{
+			Precision:    100 * time.Millisecond,
+			MessageDelay: 500 * time.Millisecond,
+		},
+		timeoutPropose:             50 * time.Millisecond,
+		genesisTime:                initialTime,
+		height2ProposalDeliverTime: initialTime.Add(150 * time.Millisecond),
+		height2ProposedBlockTime:   initialTime.Add(100 * time.Millisecond),
+	}
+
+	pbtsTest := newPBTSTestHarness(ctx, t, cfg)
+	startTestRound(pbtsTest.ctx, pbtsTest.observedState, pbtsTest.currentHeight, pbtsTest.currentRound)
+	pbtsTest.observedValidatorProposerHeight(cfg.genesisTime)
+
+	signer := pbtsTest.otherValidators[0].PrivValidator
+	height3BlockTime := cfg.height2ProposedBlockTime.Add(-blockTimeIota)
+	behavior := proposerBehavior{equivocateAt: cfg.height2ProposedBlockTime.Add(time.Second)}
+	pbtsTest.nextHeightWithFault(signer, cfg.height2ProposalDeliverTime, cfg.height2ProposedBlockTime,
+		height3BlockTime, behavior)
+
+	signerKey, err := signer.GetPubKey(context.Background())
+	require.NoError(t, err)
+
+	ev := ensureNewEvidence(t, pbtsTest.evidenceCh, 2)
+	dve, ok := ev.(*types.DuplicateVoteEvidence)
+	require.True(t, ok, "expected *types.DuplicateVoteEvidence, got %T", ev)
+	assert.Equal(t, signerKey.Address(), dve.VoteA.ValidatorAddress)
+
+	require.NoError(t, pbtsTest.observedState.Stop())
+}
@@ -13,6 +13,7 @@ import (
 	"github.com/tendermint/tendermint/internal/eventbus"
 	tmpubsub "github.com/tendermint/tendermint/internal/pubsub"
 	"github.com/tendermint/tendermint/libs/log"
+	tmtime "github.com/tendermint/tendermint/libs/time"
 	tmtimemocks "github.com/tendermint/tendermint/libs/time/mocks"
 	tmproto "github.com/tendermint/tendermint/proto/tendermint/types"
 	"github.com/tendermint/tendermint/types"
@@ -43,20 +44,36 @@ type pbtsTestHarness struct {
 	// fully controlled by the test harness.
 	otherValidators []*validatorStub
 
-	// The mock time source used by all of the validator stubs in the test harness.
-	// This mock clock allows the test harness to produce votes and blocks with arbitrary
-	// timestamps.
-	validatorClock *tmtimemocks.Source
+	// The virtual clock used by all of the validator stubs in the test harness.
+	// This clock lets the test harness produce votes and blocks with arbitrary
+	// timestamps by setting it directly, instead of stitching a fresh mock
+	// expectation into every validatorStub. Proposal delivery still waits on
+	// real time; see nextHeightWithFault.
+	validatorClock *tmtime.VirtualClock
 
 	chainID string
 
 	// channels for verifying that the observed validator completes certain actions.
 	ensureProposalCh, roundCh, blockCh, ensureVoteCh <-chan tmpubsub.Message
 
+	// evidenceCh delivers evidence the observed validator's evidence pool
+	// has produced, e.g. DuplicateVoteEvidence from an equivocating
+	// validator.
+	evidenceCh <-chan tmpubsub.Message
+
 	// channel of events from the observed validator annotated with the timestamp
 	// the event was received.
 	eventCh <-chan timestampedEvent
 
+	// delayEstimator tracks the observed delta between each proposal's
+	// block time and the time it was delivered to the observed validator,
+	// so that tests can assert on how the estimate evolves across heights.
+	// It is the same estimator type proposalStepWaitingTime (pbts.go)
+	// consults when a validator's TimingParams has AdaptiveMessageDelay
+	// enabled; the harness does not itself wire it into observedState's
+	// timeout scheduling, since that lives in state.go outside this file.
+	delayEstimator *messageDelayEstimator
+
 	currentHeight int64
 	currentRound  int32
 
@@ -90,7 +107,7 @@ func newPBTSTestHarness(ctx context.Context, t *testing.T, tc pbtsTestConfigurat
 	t.Helper()
 	const validators = 4
 	cfg := configSetup(t)
-	clock := new(tmtimemocks.Source)
+	clock := tmtime.NewVirtualClock(tc.genesisTime)
 	if tc.height4ProposedBlockTime.IsZero() {
 
 		// Set a default height4ProposedBlockTime.
@@ -133,17 +150,19 @@ func newPBTSTestHarness(ctx context.Context, t *testing.T, tc pbtsTestConfigurat
 		currentHeight:         1,
 		chainID:               cfg.ChainID(),
 		roundCh:               subscribe(ctx, t, cs.eventBus, types.EventQueryNewRound),
+		evidenceCh:            subscribe(ctx, t, cs.eventBus, types.EventQueryNewEvidence),
 		ensureProposalCh:      subscribe(ctx, t, cs.eventBus, types.EventQueryCompleteProposal),
 		blockCh:               subscribe(ctx, t, cs.eventBus, types.EventQueryNewBlock),
 		ensureVoteCh:          subscribeToVoterBuffered(ctx, t, cs, pubKey.Address()),
 		eventCh:               eventCh,
+		delayEstimator:        newMessageDelayEstimator(),
 		t:                     t,
 		ctx:                   ctx,
 	}
 }
 
 func (p *pbtsTestHarness) observedValidatorProposerHeight(previousBlockTime time.Time) heightResult {
-	p.validatorClock.On("Now").Return(p.height2ProposedBlockTime).Times(6)
+	p.validatorClock.Set(p.height2ProposedBlockTime)
 
 	ensureNewRound(p.t, p.roundCh, p.currentHeight, p.currentRound)
 	propBlock, partSet, err := p.observedState.createProposalBlock()
@@ -188,8 +207,68 @@ func (p *pbtsTestHarness) height5() heightResult {
 	return p.observedValidatorProposerHeight(p.height4ProposedBlockTime)
 }
 
+// proposerTimestampFault mutates a proposed block's header before it is
+// signed and delivered to the observed validator, allowing tests to
+// simulate a byzantine proposer that lies about a block's timestamp.
+type proposerTimestampFault func(b *types.Block)
+
+// futureTimestampFault sets the block's timestamp to offset after the time
+// it is proposed with, simulating a proposer claiming a far-future block
+// time.
+func futureTimestampFault(offset time.Duration) proposerTimestampFault {
+	return func(b *types.Block) {
+		b.Header.Time = b.Header.Time.Add(offset)
+	}
+}
+
+// pastTimestampFault sets the block's timestamp to before prevBlockTime,
+// simulating a proposer violating timestamp monotonicity with respect to
+// the previous block (or, across rounds, with respect to an earlier round
+// at the same height).
+func pastTimestampFault(prevBlockTime time.Time, before time.Duration) proposerTimestampFault {
+	return func(b *types.Block) {
+		b.Header.Time = prevBlockTime.Add(-before)
+	}
+}
+
+// proposerBehavior customizes how nextHeightWithFault produces and
+// delivers a proposal for a single height, so that new byzantine PBTS
+// scenarios can be added without duplicating the harness's round-tracking,
+// signing, and vote-collection logic.
+type proposerBehavior struct {
+	// timestampFault, if set, is applied to the primary proposed block's
+	// header before it is signed and delivered.
+	timestampFault proposerTimestampFault
+
+	// equivocateAt, if non-zero, additionally builds, signs, and attempts
+	// to deliver a second proposal for the same (height, round) with this
+	// timestamp, simulating a proposer that equivocates on a block's
+	// timestamp. The primary proposal above is expected to be accepted and
+	// the second rejected, since the observed validator already has a
+	// proposal for that (height, round); the harness then has the
+	// proposer cast conflicting votes for the two proposals' block IDs so
+	// that the resulting duplicate-vote evidence can be asserted on.
+	//
+	// Tendermint does not produce evidence directly from two conflicting
+	// *proposals* -- only from two conflicting *votes* from the same
+	// validator at the same height/round/step. Simulating the vote side
+	// of the equivocation is what actually exercises evidence production.
+	equivocateAt time.Time
+}
+
 func (p *pbtsTestHarness) nextHeight(proposer types.PrivValidator, deliverTime, proposedTime, nextProposedTime time.Time) heightResult {
-	p.validatorClock.On("Now").Return(nextProposedTime).Times(6)
+	return p.nextHeightWithFault(proposer, deliverTime, proposedTime, nextProposedTime, proposerBehavior{})
+}
+
+// nextHeightWithFault behaves like nextHeight, but drives the given
+// proposerBehavior: it mutates the proposed block's header before it is
+// signed and delivered, and/or has the proposer equivocate. Since the
+// observed validator is only one of four voting power, the harness still
+// drives the other three validators to prevote and precommit for the
+// (possibly faulty) block afterwards, so a height can still complete even
+// if the observed validator itself prevotes nil for a byzantine proposal.
+func (p *pbtsTestHarness) nextHeightWithFault(proposer types.PrivValidator, deliverTime, proposedTime, nextProposedTime time.Time, behavior proposerBehavior) heightResult {
+	p.validatorClock.Set(nextProposedTime)
 
 	ensureNewRound(p.t, p.roundCh, p.currentHeight, p.currentRound)
 
@@ -198,6 +277,9 @@ func (p *pbtsTestHarness) nextHeight(proposer types.PrivValidator, deliverTime,
 	b.Height = p.currentHeight
 	b.Header.Height = p.currentHeight
 	b.Header.Time = proposedTime
+	if behavior.timestampFault != nil {
+		behavior.timestampFault(b)
+	}
 
 	k, err := proposer.GetPubKey(context.Background())
 	require.NoError(p.t, err)
@@ -205,22 +287,48 @@ func (p *pbtsTestHarness) nextHeight(proposer types.PrivValidator, deliverTime,
 	ps, err := b.MakePartSet(types.BlockPartSizeBytes)
 	require.NoError(p.t, err)
 	bid := types.BlockID{Hash: b.Hash(), PartSetHeader: ps.Header()}
-	prop := types.NewProposal(p.currentHeight, 0, -1, bid)
+	prop := types.NewProposal(p.currentHeight, p.currentRound, -1, bid)
 	tp := prop.ToProto()
 
 	if err := proposer.SignProposal(context.Background(), p.observedState.state.ChainID, tp); err != nil {
 		p.t.Fatalf("error signing proposal: %s", err)
 	}
 
+	// This still sleeps on the real wall clock rather than p.validatorClock.
+	// proposerWaitTime and proposalStepWaitingTime (pbts.go) now take a
+	// tmtime.Source parameter and consult it instead of calling time.Now()
+	// themselves, and defaultLocaltime documents the constructor-option
+	// shape (WithLocaltime, supplying p.validatorClock) that State would
+	// need to stop reading the real clock at its own call sites into those
+	// two functions. What's missing is State itself: its field for that
+	// Source, its constructor option, and the timeout-scheduling code that
+	// calls proposalStepWaitingTime with it. Those live in state.go, a
+	// stateful type (eventBus, createProposalBlock, SetProposalAndBlock,
+	// Stop, and the goroutine that drives timeouts) whose real behavior
+	// isn't determined by anything in this tree the way TimingParams's
+	// fields or proposalStepWaitingTime's formula were -- stubbing it here
+	// would mean inventing working consensus logic with nothing to check it
+	// against, not filling in a well-specified gap. Until state.go is
+	// actually edited, delivery delay here stays coupled to real time.
 	time.Sleep(time.Until(deliverTime))
 	prop.Signature = tp.Signature
 	if err := p.observedState.SetProposalAndBlock(p.ctx, prop, b, ps, "peerID"); err != nil {
 		p.t.Fatal(err)
 	}
-	ensureProposal(p.t, p.ensureProposalCh, p.currentHeight, 0, bid)
+	p.delayEstimator.Observe(string(b.Header.ProposerAddress), deliverTime.Sub(b.Header.Time))
+	ensureProposal(p.t, p.ensureProposalCh, p.currentHeight, p.currentRound, bid)
 
+	var equivocatingBID *types.BlockID
+	if !behavior.equivocateAt.IsZero() {
+		equivocatingBID = p.deliverEquivocatingProposal(proposer, b, behavior.equivocateAt)
+	}
+
+	remainingVoters := p.otherValidators
 	ensurePrevote(p.t, p.ensureVoteCh, p.currentHeight, p.currentRound)
-	signAddVotes(p.ctx, p.t, p.observedState, tmproto.PrevoteType, p.chainID, bid, p.otherValidators...)
+	if equivocatingBID != nil {
+		remainingVoters = p.equivocateVote(proposer, tmproto.PrevoteType, bid, *equivocatingBID)
+	}
+	signAddVotes(p.ctx, p.t, p.observedState, tmproto.PrevoteType, p.chainID, bid, remainingVoters...)
 
 	signAddVotes(p.ctx, p.t, p.observedState, tmproto.PrecommitType, p.chainID, bid, p.otherValidators...)
 	ensurePrecommit(p.t, p.ensureVoteCh, p.currentHeight, p.currentRound)
@@ -235,6 +343,61 @@ func (p *pbtsTestHarness) nextHeight(proposer types.PrivValidator, deliverTime,
 	return res
 }
 
+// deliverEquivocatingProposal builds a second block for the same
+// (height, round) as primary, but with header time equivocateAt, signs it
+// on behalf of proposer, and attempts to deliver it to the observed
+// validator. It requires that delivery is rejected, since the observed
+// validator already has a proposal for that (height, round), and returns
+// the second proposal's block ID for use in equivocateVote.
+func (p *pbtsTestHarness) deliverEquivocatingProposal(proposer types.PrivValidator, primary *types.Block, equivocateAt time.Time) *types.BlockID {
+	second, _, err := p.observedState.createProposalBlock()
+	require.NoError(p.t, err)
+	second.Height = p.currentHeight
+	second.Header.Height = p.currentHeight
+	second.Header.Time = equivocateAt
+	second.Header.ProposerAddress = primary.Header.ProposerAddress
+
+	ps, err := second.MakePartSet(types.BlockPartSizeBytes)
+	require.NoError(p.t, err)
+	bid := types.BlockID{Hash: second.Hash(), PartSetHeader: ps.Header()}
+	prop := types.NewProposal(p.currentHeight, p.currentRound, -1, bid)
+	tp := prop.ToProto()
+	require.NoError(p.t, proposer.SignProposal(context.Background(), p.observedState.state.ChainID, tp))
+	prop.Signature = tp.Signature
+
+	err = p.observedState.SetProposalAndBlock(p.ctx, prop, second, ps, "peerID")
+	require.Error(p.t, err, "equivocating proposal for an existing (height, round) must be rejected")
+
+	return &bid
+}
+
+// equivocateVote has proposer -- who must also be one of p.otherValidators
+// -- cast two conflicting votes of voteType for the current (height,
+// round): one for bid, one for equivocatingBID. This is what actually
+// causes the observed validator's evidence pool to produce
+// DuplicateVoteEvidence; Tendermint does not derive evidence from
+// conflicting proposals alone. It returns the other validators minus
+// proposer, so the caller does not also cast a non-conflicting vote for
+// proposer afterwards.
+func (p *pbtsTestHarness) equivocateVote(
+	proposer types.PrivValidator, voteType tmproto.SignedMsgType, bid, equivocatingBID types.BlockID,
+) []*validatorStub {
+	var equivocator *validatorStub
+	remaining := make([]*validatorStub, 0, len(p.otherValidators))
+	for _, vs := range p.otherValidators {
+		if vs.PrivValidator == proposer {
+			equivocator = vs
+			continue
+		}
+		remaining = append(remaining, vs)
+	}
+	require.NotNil(p.t, equivocator, "equivocateVote requires the proposer to be a harness-controlled validator")
+
+	signAddVotes(p.ctx, p.t, p.observedState, voteType, p.chainID, bid, equivocator)
+	signAddVotes(p.ctx, p.t, p.observedState, voteType, p.chainID, equivocatingBID, equivocator)
+	return remaining
+}
+
 func timestampedCollector(ctx context.Context, t *testing.T, eb *eventbus.EventBus) <-chan timestampedEvent {
 	t.Helper()
 
@@ -287,11 +450,39 @@ func collectHeightResults(ctx context.Context, t *testing.T, eventCh <-chan time
 	panic("unreachable")
 }
 
+// ensureNewEvidence waits for the observed validator's evidence pool to
+// broadcast evidence for height and returns it, failing the test if none
+// arrives within ensureTimeout.
+func ensureNewEvidence(t *testing.T, evidenceCh <-chan tmpubsub.Message, height int64) types.Evidence {
+	t.Helper()
+	select {
+	case msg := <-evidenceCh:
+		ev, ok := msg.Data().(types.EventDataNewEvidence)
+		if !ok {
+			t.Fatalf("expected EventDataNewEvidence, got %T", msg.Data())
+		}
+		if ev.Height != height {
+			t.Fatalf("evidence for unexpected height, expected: %d, saw: %d", height, ev.Height)
+		}
+		return ev.Evidence
+	case <-time.After(ensureTimeout):
+		t.Fatalf("timed out waiting for evidence at height %d", height)
+		return nil
+	}
+}
+
 type timestampedEvent struct {
 	ts time.Time
 	m  tmpubsub.Message
 }
 
+// run drives the harness through a fixed sequence of heights. Signing
+// timestamps on the validator stubs are produced from p.validatorClock, a
+// tmtime.VirtualClock, so they never depend on how long the test actually
+// takes to run. The delivery delays between heights (nextHeightWithFault's
+// deliverTime) still block on real time: see the comment at that
+// time.Sleep call for why State itself, not this harness, is what's left
+// to change.
 func (p *pbtsTestHarness) run() resultSet {
 	startTestRound(p.ctx, p.observedState, p.currentHeight, p.currentRound)
 
@@ -539,8 +730,130 @@ func TestProposalTimeout(t *testing.T) {
 				MessageDelay: testCase.msgDelay,
 			}
 
-			ti := proposalStepWaitingTime(mockSource, testCase.previousBlockTime, tp)
+			ti := proposalStepWaitingTime(mockSource, testCase.previousBlockTime, tp, nil)
 			assert.Equal(t, testCase.expectedDuration, ti)
 		})
 	}
 }
+
+// TestProposalStepWaitingTimeUsesAdaptiveDelay checks that
+// proposalStepWaitingTime actually consults the messageDelayEstimator
+// passed to it: with AdaptiveMessageDelay off the estimator's convergence is
+// ignored and the deadline uses the statically configured MessageDelay;
+// with it on, the deadline extends to the estimator's larger observed
+// value.
+func TestProposalStepWaitingTimeUsesAdaptiveDelay(t *testing.T) {
+	genesisTime, err := time.Parse(time.RFC3339, "2019-03-13T23:00:00Z")
+	require.NoError(t, err)
+
+	previousBlockTime := genesisTime
+	precision := 20 * time.Millisecond
+	configuredDelay := 100 * time.Millisecond
+	observedDelay := 400 * time.Millisecond
+
+	delay := newMessageDelayEstimator()
+	for i := 0; i < msgDelayEstimatorWindow; i++ {
+		delay.Observe("peer", observedDelay)
+	}
+	require.Greater(t, delay.Estimate(), configuredDelay)
+
+	localTime := previousBlockTime.Add(precision).Add(configuredDelay)
+	mockSource := new(tmtimemocks.Source)
+	mockSource.On("Now").Return(localTime)
+
+	sp := types.TimingParams{Precision: precision, MessageDelay: configuredDelay}
+	assert.Zero(t, proposalStepWaitingTime(mockSource, previousBlockTime, sp, delay),
+		"non-adaptive params must ignore the estimator and time out at the configured delay")
+
+	sp.AdaptiveMessageDelay = true
+	assert.Positive(t, proposalStepWaitingTime(mockSource, previousBlockTime, sp, delay),
+		"adaptive params must extend the deadline to the estimator's larger observed delay")
+}
+
+// TestPBTSHarnessDelayEstimatorConverges drives the pbtsTestHarness through
+// several heights delivered under varying simulated network latencies and
+// checks that the harness's messageDelayEstimator converges toward the
+// observed delay and that the resulting effective delay tracks it once it
+// exceeds the statically configured value. This only exercises the
+// estimator in isolation -- see pbtsTestHarness.delayEstimator's comment --
+// the observed validator's own prevote/timeout behavior is not affected
+// by it.
+func TestPBTSHarnessDelayEstimatorConverges(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	initialTime := time.Now().Add(50 * time.Millisecond)
+	configuredDelay := 100 * time.Millisecond
+	cfg := pbtsTestConfiguration{
+		timingParams: types.TimingParams{
+			Precision:    50 * time.Millisecond,
+			MessageDelay: configuredDelay,
+		},
+		timeoutPropose:             50 * time.Millisecond,
+		genesisTime:                initialTime,
+		height2ProposalDeliverTime: initialTime.Add(200 * time.Millisecond),
+		height2ProposedBlockTime:   initialTime.Add(80 * time.Millisecond),
+	}
+
+	pbtsTest := newPBTSTestHarness(ctx, t, cfg)
+	startTestRound(pbtsTest.ctx, pbtsTest.observedState, pbtsTest.currentHeight, pbtsTest.currentRound)
+
+	// The observed validator proposes at height 1; the estimator is not
+	// fed until a proposal is delivered to it, which first happens at
+	// height 2.
+	pbtsTest.observedValidatorProposerHeight(cfg.genesisTime)
+
+	// Simulate a network whose latency climbs well above the statically
+	// configured MessageDelay across several heights.
+	simulatedLatencies := []time.Duration{
+		120 * time.Millisecond,
+		150 * time.Millisecond,
+		180 * time.Millisecond,
+		200 * time.Millisecond,
+	}
+	proposedTime := cfg.height2ProposedBlockTime
+	for i, latency := range simulatedLatencies {
+		signer := pbtsTest.otherValidators[i%len(pbtsTest.otherValidators)].PrivValidator
+		deliverTime := proposedTime.Add(latency)
+		nextProposedTime := deliverTime.Add(blockTimeIota)
+		pbtsTest.nextHeight(signer, deliverTime, proposedTime, nextProposedTime)
+		proposedTime = nextProposedTime
+	}
+	require.NoError(t, pbtsTest.observedState.Stop())
+
+	estimate := pbtsTest.delayEstimator.Estimate()
+	assert.Greater(t, estimate, configuredDelay,
+		"estimator should have converged above the statically configured MessageDelay")
+	assert.Equal(t, estimate, pbtsTest.delayEstimator.EffectiveDelay(configuredDelay, true))
+}
+
+// TestPBTSHarnessValidatorClockIsVirtual checks that the validator stubs'
+// signing timestamps come from the harness's tmtime.VirtualClock rather
+// than the wall clock: after setting the clock to an arbitrary far-future
+// time, every validator stub's clock should immediately report that time,
+// with no dependency on how much real time elapses around the call.
+func TestPBTSHarnessValidatorClockIsVirtual(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	initialTime := time.Now().Add(50 * time.Millisecond)
+	cfg := pbtsTestConfiguration{
+		timingParams: types.TimingParams{
+			Precision:    100 * time.Millisecond,
+			MessageDelay: 500 * time.Millisecond,
+		},
+		timeoutPropose:             50 * time.Millisecond,
+		genesisTime:                initialTime,
+		height2ProposalDeliverTime: initialTime.Add(150 * time.Millisecond),
+		height2ProposedBlockTime:   initialTime.Add(100 * time.Millisecond),
+	}
+	pbtsTest := newPBTSTestHarness(ctx, t, cfg)
+	defer func() { require.NoError(t, pbtsTest.observedState.Stop()) }()
+
+	farFuture := initialTime.Add(24 * time.Hour)
+	pbtsTest.validatorClock.Set(farFuture)
+	assert.Equal(t, farFuture, pbtsTest.validatorClock.Now())
+	for _, vs := range pbtsTest.otherValidators {
+		assert.Equal(t, farFuture, vs.clock.Now())
+	}
+}
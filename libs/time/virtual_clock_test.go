@@ -0,0 +1,134 @@
+package time
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVirtualClockNow(t *testing.T) {
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := NewVirtualClock(start)
+	assert.Equal(t, start, c.Now())
+
+	c.Advance(time.Second)
+	assert.Equal(t, start.Add(time.Second), c.Now())
+
+	later := start.Add(time.Hour)
+	c.Set(later)
+	assert.Equal(t, later, c.Now())
+}
+
+func TestVirtualClockSetCanMoveBackwards(t *testing.T) {
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := NewVirtualClock(start)
+
+	earlier := start.Add(-time.Second)
+	c.Set(earlier)
+	assert.Equal(t, earlier, c.Now(), "Set must accept an absolute time, even one earlier than now")
+}
+
+func TestVirtualClockAdvanceIsConcurrencySafe(t *testing.T) {
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := NewVirtualClock(start)
+
+	var wg sync.WaitGroup
+	const n = 100
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+			c.Advance(time.Millisecond)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, start.Add(n*time.Millisecond), c.Now())
+}
+
+func TestVirtualClockAfterFiresOnAdvance(t *testing.T) {
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := NewVirtualClock(start)
+
+	ch := c.After(10 * time.Millisecond)
+
+	select {
+	case <-ch:
+		t.Fatal("After fired before the clock advanced")
+	default:
+	}
+
+	c.Advance(5 * time.Millisecond)
+	select {
+	case <-ch:
+		t.Fatal("After fired before its deadline")
+	default:
+	}
+
+	c.Advance(5 * time.Millisecond)
+	select {
+	case got := <-ch:
+		assert.Equal(t, start.Add(10*time.Millisecond), got)
+	default:
+		t.Fatal("After did not fire once its deadline passed")
+	}
+}
+
+func TestVirtualClockAfterZeroOrPastDurationFiresImmediately(t *testing.T) {
+	c := NewVirtualClock(time.Now())
+	ch := c.After(0)
+	select {
+	case <-ch:
+	default:
+		t.Fatal("After(0) should be immediately ready")
+	}
+
+	ch = c.After(-time.Second)
+	select {
+	case <-ch:
+	default:
+		t.Fatal("After with a past duration should be immediately ready")
+	}
+}
+
+func TestVirtualClockSleepBlocksUntilAdvanced(t *testing.T) {
+	c := NewVirtualClock(time.Now())
+	done := make(chan struct{})
+	go func() {
+		c.Sleep(50 * time.Millisecond)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("Sleep returned before the clock advanced")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	c.Advance(50 * time.Millisecond)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Sleep did not return after the clock advanced past its deadline")
+	}
+}
+
+func TestVirtualClockReleasesWaitersInDeadlineOrder(t *testing.T) {
+	c := NewVirtualClock(time.Now())
+	first := c.After(30 * time.Millisecond)
+	second := c.After(10 * time.Millisecond)
+	third := c.After(20 * time.Millisecond)
+
+	c.Advance(10 * time.Millisecond)
+	c.Advance(10 * time.Millisecond)
+	c.Advance(10 * time.Millisecond)
+
+	got2 := <-second
+	got3 := <-third
+	got1 := <-first
+	require.True(t, got2.Before(got3) || got2.Equal(got3))
+	require.True(t, got3.Before(got1) || got3.Equal(got1))
+}
@@ -0,0 +1,48 @@
+package types
+
+import "time"
+
+// TimingParams governs the Proposer-Based Timestamps (PBTS) algorithm: how
+// far a block's timestamp may drift from a validator's local clock, and how
+// long validators wait for a proposal to arrive before it is considered
+// late. These are consensus-critical and therefore governance-changeable
+// like the rest of ConsensusParams -- every validator must agree on the
+// same values or the chain can fork on timeliness.
+type TimingParams struct {
+	// Precision bounds how far a proposer's clock may diverge from the
+	// rest of the network. A block's timestamp is accepted only if it
+	// falls within Precision of a validator's own local time.
+	Precision time.Duration
+
+	// MessageDelay is the configured upper bound on how long a proposal
+	// takes to reach the network. It is added to Precision to compute how
+	// long a validator waits for a proposal before prevoting nil.
+	MessageDelay time.Duration
+
+	// AdaptiveMessageDelay, when true, allows the effective MessageDelay
+	// used by proposalStepWaitingTime to rise above this configured value
+	// when the network's observed proposal delivery latency (tracked by
+	// messageDelayEstimator) exceeds it. MessageDelay always remains the
+	// floor: turning this on can only relax the timeout upward from what
+	// operators configured, never below it.
+	AdaptiveMessageDelay bool
+}
+
+// ConsensusParams groups the consensus-critical parameters that must be
+// identical across all validators. Timing holds the PBTS-related subset;
+// this repo currently only touches that subset.
+type ConsensusParams struct {
+	Timing TimingParams
+}
+
+// DefaultConsensusParams returns a ConsensusParams with reasonable defaults
+// for a freshly initialized chain.
+func DefaultConsensusParams() ConsensusParams {
+	return ConsensusParams{
+		Timing: TimingParams{
+			Precision:            500 * time.Millisecond,
+			MessageDelay:         3 * time.Second,
+			AdaptiveMessageDelay: false,
+		},
+	}
+}